@@ -2,49 +2,185 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 var (
-	dnsServerAddress       string
-	tlsClientHelloTimeout  time.Duration
-	upstreamConnectTimeout time.Duration
+	dnsServerAddress        string
+	tlsClientHelloTimeout   time.Duration
+	upstreamConnectTimeout  time.Duration
+	rulesFilePath           string
+	proxyProtocolUpstream   string
+	proxyProtocolDownstream string
+	upstreamProxyURL        string
+	metricsAddr             string
+	terminationDelay        time.Duration
+	shutdownTimeout         time.Duration
+	maxConcurrentSessions   int
+
+	router              *Router
+	dnsResolver         resolver
+	upstreamProxyDialer upstreamDialer
+	logger              *slog.Logger
+	sessionSem          chan struct{}
+
+	activeConnsMu sync.Mutex
+	activeConns   = make(map[net.Conn]struct{})
 )
 
+// happyEyeballsDelay is the stagger between successive connection
+// attempts in dialUpstream, per RFC 8305 section 5.
+const happyEyeballsDelay = 250 * time.Millisecond
+
 func main() {
-	flag.StringVar(&dnsServerAddress, "dns-server", "114.114.114.114:53", "Address of the DNS server")
+	flag.StringVar(&dnsServerAddress, "dns-server", "114.114.114.114:53", "Address of the DNS server, as host:port, or a udp://, tls://, or https:// URI")
 	flag.DurationVar(&tlsClientHelloTimeout, "tls-client-hello-timeout", 5*time.Second, "TLS client hello timeout")
 	flag.DurationVar(&upstreamConnectTimeout, "upstream-connect-timeout", 5*time.Second, "Upstream connect timeout")
+	flag.StringVar(&rulesFilePath, "rules-file", "", "Path to a JSON or YAML (.yaml/.yml) SNI routing rules file (reloaded on SIGHUP)")
+	flag.StringVar(&proxyProtocolUpstream, "proxy-protocol-upstream", "off", "Emit PROXY protocol toward the upstream: v1, v2, or off")
+	flag.StringVar(&proxyProtocolDownstream, "proxy-protocol-downstream", "off", "Expect PROXY protocol from downstream: off, v1, v2, or optional")
+	flag.StringVar(&upstreamProxyURL, "upstream-proxy", "", "Dial the upstream through this proxy: socks5://[user:pass@]host:port or http://[user:pass@]host:port")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus /metrics on (disabled if empty)")
+	flag.DurationVar(&terminationDelay, "termination-delay", 100*time.Millisecond, "How long to wait for the other side of a proxied connection to close on its own, after one side has, before forcing it shut")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight connections to drain on shutdown before forcibly closing them")
+	flag.IntVar(&maxConcurrentSessions, "max-concurrent-sessions", 0, "Maximum number of concurrent proxied sessions; excess connections are rejected (0 = unbounded)")
 
 	flag.Parse()
 
+	if maxConcurrentSessions > 0 {
+		sessionSem = make(chan struct{}, maxConcurrentSessions)
+	}
+
+	logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	switch proxyProtocolUpstream {
+	case "off", "v1", "v2":
+	default:
+		log.Fatalf("Invalid -proxy-protocol-upstream value %q", proxyProtocolUpstream)
+	}
+	switch proxyProtocolDownstream {
+	case "off", "v1", "v2", "optional":
+	default:
+		log.Fatalf("Invalid -proxy-protocol-downstream value %q", proxyProtocolDownstream)
+	}
+
 	log.Println("Starting server with configurations:")
 	log.Printf("DNS Server Address: %s", dnsServerAddress)
 	log.Printf("TLS Client Hello Timeout: %v", tlsClientHelloTimeout)
 	log.Printf("Upstream Connect Timeout: %v", upstreamConnectTimeout)
+	log.Printf("Rules File: %s", rulesFilePath)
+
+	var err error
+	router, err = NewRouter(rulesFilePath)
+	if err != nil {
+		log.Fatalf("Failed to load rules file: %v", err)
+	}
+	registerRuleMetrics(router)
+
+	baseResolver, err := newResolver(dnsServerAddress)
+	if err != nil {
+		log.Fatalf("Failed to configure DNS resolver: %v", err)
+	}
+	dnsResolver = newCachingResolver(baseResolver)
+
+	upstreamProxyDialer, err = newUpstreamDialer(upstreamProxyURL)
+	if err != nil {
+		log.Fatalf("Failed to configure upstream proxy: %v", err)
+	}
+
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
 
 	l, err := net.Listen("tcp", ":443")
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received signal %s, shutting down", sig)
+		cancel()
+		l.Close()
+	}()
+
+	var connWG sync.WaitGroup
+
 	log.Printf("Listening on %s", l.Addr().String())
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			log.Print(err)
-			continue
+			select {
+			case <-ctx.Done():
+				waitForDrain(&connWG, shutdownTimeout)
+				log.Println("All connections drained, exiting")
+				return
+			default:
+				log.Print(err)
+				continue
+			}
 		}
-		go handleConnection(conn)
+
+		if sessionSem != nil {
+			select {
+			case sessionSem <- struct{}{}:
+			default:
+				log.Printf("Rejecting connection from %s: max concurrent sessions reached", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+		}
+
+		acceptedConnectionsTotal.Inc()
+		connWG.Add(1)
+		go func() {
+			defer connWG.Done()
+			if sessionSem != nil {
+				defer func() { <-sessionSem }()
+			}
+			handleConnection(conn)
+		}()
+	}
+}
+
+// waitForDrain blocks until connWG finishes or timeout elapses, forcibly
+// closing any connections still tracked in activeConns if the timeout is
+// reached.
+func waitForDrain(connWG *sync.WaitGroup, timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		connWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Printf("Shutdown timeout of %v reached, forcibly closing remaining connections", timeout)
+		activeConnsMu.Lock()
+		for conn := range activeConns {
+			conn.Close()
+		}
+		activeConnsMu.Unlock()
+		<-drained
 	}
 }
 
@@ -90,87 +226,278 @@ func readClientHello(reader io.Reader) (*tls.ClientHelloInfo, error) {
 	return hello, nil
 }
 
-func resolveServerNameToIP(serverName string) (string, error) {
-	c := dns.Client{}
-	m := dns.Msg{}
+// resolveServerNameToIPs queries both A and AAAA records for serverName and
+// returns the candidate addresses ordered for a Happy-Eyeballs-style dial:
+// IPv6 first, interleaved with IPv4 per the preference order described in
+// RFC 6724.
+func resolveServerNameToIPs(serverName string) ([]netip.Addr, error) {
+	v6, err6 := lookupAddrs(serverName, dns.TypeAAAA)
+	v4, err4 := lookupAddrs(serverName, dns.TypeA)
+	if err6 != nil && err4 != nil {
+		return nil, err6
+	}
+
+	addrs := make([]netip.Addr, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("unknown host %s", serverName)
+	}
+
+	return addrs, nil
+}
+
+func lookupAddrs(serverName string, qtype uint16) ([]netip.Addr, error) {
+	addrs, _, err := dnsResolver.resolve(dns.Fqdn(serverName), qtype)
+	return addrs, err
+}
 
-	m.SetQuestion(dns.Fqdn(serverName), dns.TypeA)
-	r, _, err := c.Exchange(&m, dnsServerAddress)
-	if err != nil {
-		return "", err
+// dialUpstream races TCP dials against candidateAddrs, staggered by
+// happyEyeballsDelay, and returns the connection of whichever attempt
+// completes first within timeout. All losing attempts are cancelled.
+func dialUpstream(candidateAddrs []netip.Addr, port string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		addr netip.Addr
+		err  error
 	}
 
-	for _, ans := range r.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			return a.A.String(), nil
+	resultCh := make(chan result, len(candidateAddrs))
+	var wg sync.WaitGroup
+
+	for i, addr := range candidateAddrs {
+		wg.Add(1)
+		go func(i int, addr netip.Addr) {
+			defer wg.Done()
+
+			select {
+			case <-time.After(time.Duration(i) * happyEyeballsDelay):
+			case <-ctx.Done():
+				resultCh <- result{addr: addr, err: ctx.Err()}
+				return
+			}
+
+			conn, err := upstreamProxyDialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+			resultCh <- result{conn: conn, addr: addr, err: err}
+		}(i, addr)
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	var firstErr error
+	for res := range resultCh {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
 		}
+
+		cancel()
+		log.Printf("Upstream dial won by %s", res.addr)
+
+		go func() {
+			for leftover := range resultCh {
+				if leftover.conn != nil {
+					leftover.conn.Close()
+				}
+			}
+		}()
+
+		return res.conn, nil
 	}
 
-	return "", fmt.Errorf("unknown host %s", serverName)
+	return nil, fmt.Errorf("failed to connect to any resolved address: %w", firstErr)
 }
 
 func handleConnection(clientConn net.Conn) {
 	defer clientConn.Close()
 
-	log.Printf("Received connection from %s", clientConn.RemoteAddr().String())
+	activeConnsMu.Lock()
+	activeConns[clientConn] = struct{}{}
+	activeConnsMu.Unlock()
+	defer func() {
+		activeConnsMu.Lock()
+		delete(activeConns, clientConn)
+		activeConnsMu.Unlock()
+	}()
+
+	realRemoteAddr := clientConn.RemoteAddr()
+	connLogger := logger.With(slog.String("remote_addr", realRemoteAddr.String()))
+	connLogger.Info("Received connection", slog.String("phase", "accept"))
 
 	if err := clientConn.SetReadDeadline(time.Now().Add(tlsClientHelloTimeout)); err != nil {
-		log.Print(err)
+		connLogger.Error("Error setting ClientHello read deadline", slog.String("phase", "client_hello"), slog.Any("err", err))
 		return
 	}
 
-	clientHello, clientReader, err := peekClientHello(clientConn)
+	var downstreamReader io.Reader = clientConn
+	if proxyProtocolDownstream != "off" {
+		addr, rest, err := peekProxyProtocolHeader(clientConn, proxyProtocolDownstream)
+		if err != nil {
+			connLogger.Error("Error reading PROXY protocol header", slog.String("phase", "proxy_protocol"), slog.Any("err", err))
+			return
+		}
+		downstreamReader = rest
+		if addr != nil {
+			realRemoteAddr = addr
+			connLogger = logger.With(slog.String("remote_addr", realRemoteAddr.String()))
+			connLogger.Info("Recovered real client address from PROXY protocol", slog.String("phase", "proxy_protocol"))
+		}
+	}
+
+	clientHello, clientReader, err := peekClientHello(downstreamReader)
 	if err != nil {
-		log.Printf("Error peeking client hello from %s: %v", clientConn.RemoteAddr().String(), err)
+		clientHelloParseFailuresTotal.Inc()
+		connLogger.Error("Error peeking client hello", slog.String("phase", "client_hello"), slog.Any("err", err))
 		return
 	}
 
+	connLogger = connLogger.With(slog.String("sni", clientHello.ServerName))
+
 	if err := clientConn.SetReadDeadline(time.Time{}); err != nil {
-		log.Print(err)
+		connLogger.Error("Error clearing ClientHello read deadline", slog.String("phase", "client_hello"), slog.Any("err", err))
 		return
 	}
 
-	ip, err := resolveServerNameToIP(clientHello.ServerName)
-	if err != nil {
-		log.Printf("Failed to resolve server name %s from connection %s: %v", clientHello.ServerName, clientConn.RemoteAddr().String(), err)
+	decision := router.Decide(clientHello.ServerName)
+	if decision.Action == RuleActionDeny {
+		connLogger.Info("Denying connection", slog.String("phase", "route"))
+		if decision.ResetConn {
+			resetConn(clientConn)
+		}
 		return
 	}
 
-	log.Printf("Proxying requests for domain %s (resolved as %s) from client %s", clientHello.ServerName, ip, clientConn.RemoteAddr().String())
+	var backendConn net.Conn
+	if decision.Action == RuleActionStatic {
+		staticCtx, staticCancel := context.WithTimeout(context.Background(), upstreamConnectTimeout)
+		connectStart := time.Now()
+		backendConn, err = upstreamProxyDialer.DialContext(staticCtx, "tcp", decision.StaticAddr)
+		staticCancel()
+		upstreamConnectDuration.Observe(time.Since(connectStart).Seconds())
+		if err != nil {
+			upstreamConnectFailuresTotal.Inc()
+			connLogger.Error("Error connecting to static backend", slog.String("phase", "upstream_connect"), slog.String("upstream_addr", decision.StaticAddr), slog.Any("err", err))
+			return
+		}
+	} else {
+		lookupName := clientHello.ServerName
+		if decision.Action == RuleActionRewrite {
+			lookupName = decision.RewriteTo
+		}
+
+		resolveStart := time.Now()
+		candidateAddrs, resolveErr := resolveServerNameToIPs(lookupName)
+		dnsResolutionDuration.Observe(time.Since(resolveStart).Seconds())
+		if resolveErr != nil {
+			dnsResolutionFailuresTotal.WithLabelValues(dnsRcodeLabel(resolveErr)).Inc()
+			connLogger.Error("Failed to resolve server name", slog.String("phase", "dns"), slog.Any("err", resolveErr))
+			return
+		}
 
-	backendConn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, "443"), upstreamConnectTimeout)
-	if err != nil {
-		log.Printf("Error connecting to backend for %s: %v", clientHello.ServerName, err)
-		return
+		connLogger.Info("Resolved upstream candidates", slog.String("phase", "dns"), slog.Any("resolved_ip", candidateAddrs))
+
+		connectStart := time.Now()
+		backendConn, err = dialUpstream(candidateAddrs, "443", upstreamConnectTimeout)
+		upstreamConnectDuration.Observe(time.Since(connectStart).Seconds())
+		if err != nil {
+			upstreamConnectFailuresTotal.Inc()
+			connLogger.Error("Error connecting to backend", slog.String("phase", "upstream_connect"), slog.Any("err", err))
+			return
+		}
 	}
 	defer backendConn.Close()
 
-	log.Printf("Successfully connected to backend %s for client %s", backendConn.RemoteAddr().String(), clientConn.RemoteAddr().String())
+	activeConnsMu.Lock()
+	activeConns[backendConn] = struct{}{}
+	activeConnsMu.Unlock()
+	defer func() {
+		activeConnsMu.Lock()
+		delete(activeConns, backendConn)
+		activeConnsMu.Unlock()
+	}()
+
+	connLogger = connLogger.With(slog.String("upstream_addr", backendConn.RemoteAddr().String()))
+	connLogger.Info("Successfully connected to backend", slog.String("phase", "upstream_connect"))
 
-	proxyTraffic(clientConn, backendConn, clientReader)
+	if proxyProtocolUpstream != "off" {
+		srcAddr, srcOK := realRemoteAddr.(*net.TCPAddr)
+		dstAddr, dstOK := clientConn.LocalAddr().(*net.TCPAddr)
+		if !srcOK || !dstOK {
+			connLogger.Error("Cannot emit PROXY protocol: non-TCP address", slog.String("phase", "proxy_protocol"))
+			return
+		}
+		if err := writeProxyProtocolHeader(backendConn, proxyProtocolUpstream, srcAddr, dstAddr); err != nil {
+			connLogger.Error("Error writing PROXY protocol header to backend", slog.String("phase", "proxy_protocol"), slog.Any("err", err))
+			return
+		}
+	}
+
+	activeProxiedConnections.Inc()
+	defer activeProxiedConnections.Dec()
+
+	sessionStart := time.Now()
+	proxyTraffic(clientConn, backendConn, clientReader, connLogger, sniLabel(clientHello.ServerName))
+	sessionDurationSeconds.WithLabelValues(sniLabel(clientHello.ServerName)).Observe(time.Since(sessionStart).Seconds())
 }
 
-func proxyTraffic(clientConn, backendConn net.Conn, clientReader io.Reader) {
-	var wg sync.WaitGroup
-	wg.Add(2)
+// resetConn forces a TCP RST instead of a clean FIN on close, used when a
+// rule denies a connection with reset=true.
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+func proxyTraffic(clientConn, backendConn net.Conn, clientReader io.Reader, connLogger *slog.Logger, sniBucket string) {
+	done := make(chan struct{}, 2)
 
 	go func() {
-		_, err := io.Copy(clientConn, backendConn)
+		n, err := io.Copy(clientConn, backendConn)
+		bytesTransferredTotal.WithLabelValues("upstream_to_client", sniBucket).Add(float64(n))
 		if err != nil {
-			log.Printf("Error copying data from backend to client: %v", err)
+			connLogger.Error("Error copying data from backend to client", slog.String("phase", "proxy"), slog.Any("err", err))
 		}
 		clientConn.(*net.TCPConn).CloseWrite()
-		wg.Done()
+		done <- struct{}{}
 	}()
 	go func() {
-		_, err := io.Copy(backendConn, clientReader)
+		n, err := io.Copy(backendConn, clientReader)
+		bytesTransferredTotal.WithLabelValues("client_to_upstream", sniBucket).Add(float64(n))
 		if err != nil {
-			log.Printf("Error copying data from client to backend: %v", err)
+			connLogger.Error("Error copying data from client to backend", slog.String("phase", "proxy"), slog.Any("err", err))
 		}
 		backendConn.(*net.TCPConn).CloseWrite()
-		wg.Done()
+		done <- struct{}{}
 	}()
 
-	wg.Wait()
-	log.Printf("Finished proxying for client %s to backend %s", clientConn.RemoteAddr().String(), backendConn.RemoteAddr().String())
+	// The first direction to finish means one peer half-closed its side.
+	// Give the other direction up to terminationDelay to notice and close
+	// on its own (e.g. a backend that never reads after CloseWrite would
+	// otherwise hang io.Copy forever) before forcing both sides shut.
+	<-done
+	select {
+	case <-done:
+	case <-time.After(terminationDelay):
+		connLogger.Info("Termination delay elapsed, forcing connection closed", slog.String("phase", "proxy"))
+		clientConn.Close()
+		backendConn.Close()
+		<-done
+	}
+
+	connLogger.Info("Finished proxying", slog.String("phase", "proxy"))
 }
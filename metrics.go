@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sniCardinalityBuckets bounds how many distinct "sni" label values the
+// bytes-transferred and session-duration metrics can take on, so that an
+// attacker offering arbitrary SNIs can't blow up metric cardinality.
+const sniCardinalityBuckets = 64
+
+var (
+	acceptedConnectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "anti_host_file_block_accepted_connections_total",
+		Help: "Total number of client connections accepted.",
+	})
+
+	clientHelloParseFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "anti_host_file_block_client_hello_parse_failures_total",
+		Help: "Total number of connections that failed to yield a valid TLS ClientHello.",
+	})
+
+	dnsResolutionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anti_host_file_block_dns_resolution_duration_seconds",
+		Help:    "Latency of upstream DNS resolution.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	dnsResolutionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anti_host_file_block_dns_resolution_failures_total",
+		Help: "Total number of failed DNS resolutions, labelled by rcode.",
+	}, []string{"rcode"})
+
+	upstreamConnectDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "anti_host_file_block_upstream_connect_duration_seconds",
+		Help:    "Latency of connecting to the resolved upstream.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	upstreamConnectFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "anti_host_file_block_upstream_connect_failures_total",
+		Help: "Total number of failed upstream connection attempts.",
+	})
+
+	activeProxiedConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "anti_host_file_block_active_proxied_connections",
+		Help: "Number of client connections currently being proxied.",
+	})
+
+	bytesTransferredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anti_host_file_block_bytes_transferred_total",
+		Help: "Total bytes proxied, labelled by direction and a bounded SNI bucket.",
+	}, []string{"direction", "sni"})
+
+	sessionDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "anti_host_file_block_session_duration_seconds",
+		Help:    "Duration of a proxied session, labelled by a bounded SNI bucket.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"sni"})
+
+	ruleMatchesDesc = prometheus.NewDesc(
+		"anti_host_file_block_rule_matches_total",
+		"Total number of times each routing rule has matched a client SNI, labelled by rule pattern.",
+		[]string{"pattern"}, nil,
+	)
+)
+
+// ruleMatchCollector exposes a Router's per-rule match counters as a
+// Prometheus metric. It pulls a fresh snapshot from router.Counters() on
+// every scrape rather than mirroring the counts into its own storage.
+type ruleMatchCollector struct {
+	router *Router
+}
+
+func (c *ruleMatchCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ruleMatchesDesc
+}
+
+func (c *ruleMatchCollector) Collect(ch chan<- prometheus.Metric) {
+	for pattern, count := range c.router.Counters() {
+		ch <- prometheus.MustNewConstMetric(ruleMatchesDesc, prometheus.CounterValue, float64(count), pattern)
+	}
+}
+
+// registerRuleMetrics registers router's per-rule match counters for
+// scraping. It's called once from main after the Router is constructed,
+// since the rule-match collector needs a live *Router to pull from.
+func registerRuleMetrics(router *Router) {
+	prometheus.MustRegister(&ruleMatchCollector{router: router})
+}
+
+func init() {
+	prometheus.MustRegister(
+		acceptedConnectionsTotal,
+		clientHelloParseFailuresTotal,
+		dnsResolutionDuration,
+		dnsResolutionFailuresTotal,
+		upstreamConnectDuration,
+		upstreamConnectFailuresTotal,
+		activeProxiedConnections,
+		bytesTransferredTotal,
+		sessionDurationSeconds,
+	)
+}
+
+// sniLabel maps an arbitrary SNI to one of sniCardinalityBuckets bucket
+// labels, so per-SNI metrics stay bounded in size regardless of how many
+// distinct hostnames clients present.
+func sniLabel(serverName string) string {
+	h := fnv.New32a()
+	h.Write([]byte(serverName))
+	return fmt.Sprintf("bucket-%d", h.Sum32()%sniCardinalityBuckets)
+}
+
+// serveMetrics starts the Prometheus /metrics endpoint on addr. It runs for
+// the lifetime of the process; a listen failure is fatal since it most
+// likely means addr is misconfigured.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	log.Printf("Serving Prometheus metrics on %s/metrics", addr)
+	log.Fatal(server.ListenAndServe())
+}
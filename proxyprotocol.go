@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtoV2Signature is the fixed 12-byte magic that prefixes every
+// PROXY protocol v2 header (see the spec at haproxy.org/download/2.0/doc/proxy-protocol.txt).
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// writeProxyProtocolHeader emits a PROXY protocol header for the connection
+// (srcAddr, dstAddr) to w, in either v1 (text) or v2 (binary) form.
+func writeProxyProtocolHeader(w io.Writer, version string, srcAddr, dstAddr *net.TCPAddr) error {
+	switch version {
+	case "v1":
+		return writeProxyProtocolV1(w, srcAddr, dstAddr)
+	case "v2":
+		return writeProxyProtocolV2(w, srcAddr, dstAddr)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+}
+
+func writeProxyProtocolV1(w io.Writer, srcAddr, dstAddr *net.TCPAddr) error {
+	family := "TCP4"
+	if srcAddr.IP.To4() == nil {
+		family = "TCP6"
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, srcAddr.IP.String(), dstAddr.IP.String(), srcAddr.Port, dstAddr.Port)
+	return err
+}
+
+func writeProxyProtocolV2(w io.Writer, srcAddr, dstAddr *net.TCPAddr) error {
+	header := bytes.NewBuffer(nil)
+	header.Write(proxyProtoV2Signature)
+	header.WriteByte(0x21) // version 2, command PROXY
+
+	srcIP4 := srcAddr.IP.To4()
+	dstIP4 := dstAddr.IP.To4()
+	if srcIP4 != nil && dstIP4 != nil {
+		header.WriteByte(0x11) // AF_INET, STREAM
+		binary.Write(header, binary.BigEndian, uint16(12))
+		header.Write(srcIP4)
+		header.Write(dstIP4)
+	} else {
+		header.WriteByte(0x21) // AF_INET6, STREAM
+		binary.Write(header, binary.BigEndian, uint16(36))
+		header.Write(srcAddr.IP.To16())
+		header.Write(dstAddr.IP.To16())
+	}
+	binary.Write(header, binary.BigEndian, uint16(srcAddr.Port))
+	binary.Write(header, binary.BigEndian, uint16(dstAddr.Port))
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// peekProxyProtocolHeader inspects the start of reader for a PROXY protocol
+// header. mode is one of "v1" or "v2" (require exactly that version) or
+// "optional" (accept either version, or no header at all). It returns the
+// real source address carried by the header (nil if none was present) and a
+// reader that yields the remaining, unconsumed bytes of the connection.
+func peekProxyProtocolHeader(reader io.Reader, mode string) (net.Addr, io.Reader, error) {
+	br := bufio.NewReaderSize(reader, 4096)
+
+	signature, err := br.Peek(len(proxyProtoV2Signature))
+	if err == nil && bytes.Equal(signature, proxyProtoV2Signature) {
+		if mode == "v1" {
+			return nil, br, fmt.Errorf("expected PROXY protocol v1 header, got v2")
+		}
+		addr, err := readProxyProtocolV2(br)
+		return addr, br, err
+	}
+
+	prefix, err := br.Peek(5)
+	if err == nil && string(prefix) == "PROXY" {
+		if mode == "v2" {
+			return nil, br, fmt.Errorf("expected PROXY protocol v2 header, got v1")
+		}
+		addr, err := readProxyProtocolV1(br)
+		return addr, br, err
+	}
+
+	if mode == "optional" {
+		return nil, br, nil
+	}
+
+	return nil, br, fmt.Errorf("expected PROXY protocol %s header, none found", mode)
+}
+
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY v1 header: %w", err)
+	}
+
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source port: %w", err)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source address: %q", fields[2])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: srcPort}, nil
+}
+
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtoV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	addrBlock := make([]byte, length)
+	if _, err := io.ReadFull(br, addrBlock); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 address block: %w", err)
+	}
+
+	if command == 0x0 { // LOCAL: no real connection info, typically a health check
+		return nil, nil
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(addrBlock) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addrBlock[0:4]),
+			Port: int(binary.BigEndian.Uint16(addrBlock[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(addrBlock) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addrBlock[0:16]),
+			Port: int(binary.BigEndian.Uint16(addrBlock[32:34])),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolV1RoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 12345}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	buf := &bytes.Buffer{}
+	if err := writeProxyProtocolHeader(buf, "v1", src, dst); err != nil {
+		t.Fatalf("writeProxyProtocolHeader: %v", err)
+	}
+	buf.WriteString("REMAINDER")
+
+	addr, rest, err := peekProxyProtocolHeader(buf, "v1")
+	if err != nil {
+		t.Fatalf("peekProxyProtocolHeader: %v", err)
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(src.IP) || tcpAddr.Port != src.Port {
+		t.Errorf("recovered addr = %v, want %v", addr, src)
+	}
+
+	remainder, err := io.ReadAll(rest)
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if string(remainder) != "REMAINDER" {
+		t.Errorf("remainder = %q, want %q", remainder, "REMAINDER")
+	}
+}
+
+func TestProxyProtocolV2RoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 12345}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	buf := &bytes.Buffer{}
+	if err := writeProxyProtocolHeader(buf, "v2", src, dst); err != nil {
+		t.Fatalf("writeProxyProtocolHeader: %v", err)
+	}
+	buf.WriteString("REMAINDER")
+
+	addr, rest, err := peekProxyProtocolHeader(buf, "v2")
+	if err != nil {
+		t.Fatalf("peekProxyProtocolHeader: %v", err)
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(src.IP) || tcpAddr.Port != src.Port {
+		t.Errorf("recovered addr = %v, want %v", addr, src)
+	}
+
+	remainder, err := io.ReadAll(rest)
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if string(remainder) != "REMAINDER" {
+		t.Errorf("remainder = %q, want %q", remainder, "REMAINDER")
+	}
+}
+
+func TestPeekProxyProtocolHeaderEnforcesRequestedVersion(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 12345}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	tests := []struct {
+		name       string
+		headerVers string
+		mode       string
+		wantErr    bool
+	}{
+		{"v1 header with v1 mode", "v1", "v1", false},
+		{"v2 header with v2 mode", "v2", "v2", false},
+		{"v1 header with v2 mode is rejected", "v1", "v2", true},
+		{"v2 header with v1 mode is rejected", "v2", "v1", true},
+		{"v1 header with optional mode", "v1", "optional", false},
+		{"v2 header with optional mode", "v2", "optional", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := writeProxyProtocolHeader(buf, tc.headerVers, src, dst); err != nil {
+				t.Fatalf("writeProxyProtocolHeader: %v", err)
+			}
+
+			_, _, err := peekProxyProtocolHeader(buf, tc.mode)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("peekProxyProtocolHeader(mode=%s) for a %s header: err = %v, wantErr %v", tc.mode, tc.headerVers, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPeekProxyProtocolHeaderRequiredButAbsent(t *testing.T) {
+	buf := bytes.NewBufferString("not a proxy protocol header")
+
+	if _, _, err := peekProxyProtocolHeader(buf, "v1"); err == nil {
+		t.Fatal("expected an error when mode=v1 and no header is present, got nil")
+	}
+}
+
+func TestPeekProxyProtocolHeaderOptionalAbsent(t *testing.T) {
+	buf := bytes.NewBufferString("plain TLS ClientHello bytes")
+
+	addr, rest, err := peekProxyProtocolHeader(buf, "optional")
+	if err != nil {
+		t.Fatalf("peekProxyProtocolHeader: %v", err)
+	}
+	if addr != nil {
+		t.Errorf("addr = %v, want nil", addr)
+	}
+
+	remainder, err := io.ReadAll(rest)
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if string(remainder) != "plain TLS ClientHello bytes" {
+		t.Errorf("remainder = %q, want original bytes untouched", remainder)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolver is a pluggable DNS transport. It returns the resolved addresses
+// for qname/qtype along with the minimum TTL (in seconds) seen across the
+// A and AAAA records of the answer section, so a wrapping cache can honor
+// the record's own lifetime.
+type resolver interface {
+	resolve(qname string, qtype uint16) (addrs []netip.Addr, ttl uint32, err error)
+}
+
+// newResolver builds a resolver from a -dns-server value. Accepted forms are
+// a bare "host:port" (plain DNS over UDP, the historical default),
+// "udp://host:port", "tls://host:port" for DNS-over-TLS (RFC 7858), and an
+// "https://..." URL for DNS-over-HTTPS (RFC 8484).
+func newResolver(dnsServer string) (resolver, error) {
+	if !strings.Contains(dnsServer, "://") {
+		dnsServer = "udp://" + dnsServer
+	}
+
+	u, err := url.Parse(dnsServer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DNS server %q: %w", dnsServer, err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &classicResolver{addr: u.Host}, nil
+	case "tls":
+		return &classicResolver{addr: u.Host, net: "tcp-tls"}, nil
+	case "https":
+		return &dohResolver{endpoint: dnsServer, httpClient: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS server scheme %q", u.Scheme)
+	}
+}
+
+// classicResolver speaks plain DNS over UDP, or DNS-over-TLS when net is set
+// to "tcp-tls".
+type classicResolver struct {
+	addr string
+	net  string
+}
+
+func (cr *classicResolver) resolve(qname string, qtype uint16) ([]netip.Addr, uint32, error) {
+	c := dns.Client{Net: cr.net}
+	m := dns.Msg{}
+	m.SetQuestion(qname, qtype)
+
+	r, _, err := c.Exchange(&m, cr.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, 0, &dnsError{rcode: r.Rcode}
+	}
+
+	return addrsFromAnswer(r.Answer)
+}
+
+// dohResolver speaks DNS-over-HTTPS using the "application/dns-message"
+// wire format (RFC 8484 section 4.1).
+type dohResolver struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+func (dr *dohResolver) resolve(qname string, qtype uint16) ([]netip.Addr, uint32, error) {
+	m := dns.Msg{}
+	m.SetQuestion(qname, qtype)
+	m.Id = 0
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("packing DoH query: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dr.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, fmt.Errorf("building DoH request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dr.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("DoH request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH request returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading DoH response: %w", err)
+	}
+
+	var r dns.Msg
+	if err := r.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("unpacking DoH response: %w", err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, 0, &dnsError{rcode: r.Rcode}
+	}
+
+	return addrsFromAnswer(r.Answer)
+}
+
+// dnsError reports a non-success DNS response code, letting callers (e.g.
+// metrics) distinguish rcodes like NXDOMAIN from transport failures.
+type dnsError struct {
+	rcode int
+}
+
+func (e *dnsError) Error() string {
+	return fmt.Sprintf("dns query failed: %s", dns.RcodeToString[e.rcode])
+}
+
+// dnsRcodeLabel extracts a Prometheus-friendly rcode label from a resolve
+// error, falling back to "transport_error" for failures (timeouts,
+// connection refused, malformed responses) that never got as far as an
+// rcode.
+func dnsRcodeLabel(err error) string {
+	var dErr *dnsError
+	if errors.As(err, &dErr) {
+		return dns.RcodeToString[dErr.rcode]
+	}
+	return "transport_error"
+}
+
+func addrsFromAnswer(answer []dns.RR) ([]netip.Addr, uint32, error) {
+	var addrs []netip.Addr
+	var minTTL uint32
+	seenTTL := false
+
+	for _, ans := range answer {
+		var ttl uint32
+		switch rr := ans.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+				addrs = append(addrs, addr)
+			}
+			ttl = rr.Hdr.Ttl
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(rr.AAAA.To16()); ok {
+				addrs = append(addrs, addr)
+			}
+			ttl = rr.Hdr.Ttl
+		default:
+			continue
+		}
+
+		if !seenTTL || ttl < minTTL {
+			minTTL = ttl
+			seenTTL = true
+		}
+	}
+
+	return addrs, minTTL, nil
+}
+
+const (
+	// maxCachedResolutions bounds the resolver cache so a flood of unique
+	// SNIs cannot grow it without limit.
+	maxCachedResolutions = 10000
+	// negativeCacheTTL is how long a lookup that returned no addresses (or
+	// failed outright) is cached for, since such answers don't carry a TTL
+	// of their own.
+	negativeCacheTTL = 30 * time.Second
+)
+
+type resolverCacheKey struct {
+	qname string
+	qtype uint16
+}
+
+type resolverCacheEntry struct {
+	addrs     []netip.Addr
+	err       error
+	expiresAt time.Time
+}
+
+// cachingResolver wraps a resolver with a bounded, TTL-respecting cache of
+// both positive and negative answers, shared across all goroutines handling
+// connections.
+type cachingResolver struct {
+	underlying resolver
+
+	mu      sync.Mutex
+	entries map[resolverCacheKey]resolverCacheEntry
+}
+
+func newCachingResolver(underlying resolver) *cachingResolver {
+	return &cachingResolver{
+		underlying: underlying,
+		entries:    make(map[resolverCacheKey]resolverCacheEntry),
+	}
+}
+
+func (cr *cachingResolver) resolve(qname string, qtype uint16) ([]netip.Addr, uint32, error) {
+	key := resolverCacheKey{qname: strings.ToLower(qname), qtype: qtype}
+
+	cr.mu.Lock()
+	entry, ok := cr.entries[key]
+	cr.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.addrs, uint32(time.Until(entry.expiresAt) / time.Second), entry.err
+	}
+
+	addrs, ttl, err := cr.underlying.resolve(qname, qtype)
+
+	ttlDuration := negativeCacheTTL
+	if err == nil && len(addrs) > 0 {
+		ttlDuration = time.Duration(ttl) * time.Second
+	}
+
+	cr.mu.Lock()
+	if _, exists := cr.entries[key]; !exists && len(cr.entries) >= maxCachedResolutions {
+		for evict := range cr.entries {
+			delete(cr.entries, evict)
+			break
+		}
+	}
+	cr.entries[key] = resolverCacheEntry{addrs: addrs, err: err, expiresAt: time.Now().Add(ttlDuration)}
+	cr.mu.Unlock()
+
+	return addrs, ttl, err
+}
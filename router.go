@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleAction describes what to do with a connection whose SNI matches a Rule.
+type RuleAction string
+
+const (
+	// RuleActionAllow lets the connection proceed through the normal
+	// resolve-and-dial path.
+	RuleActionAllow RuleAction = "allow"
+	// RuleActionDeny closes the connection instead of proxying it.
+	RuleActionDeny RuleAction = "deny"
+	// RuleActionRewrite resolves a different hostname than the one the
+	// client presented in its ClientHello.
+	RuleActionRewrite RuleAction = "rewrite"
+	// RuleActionStatic skips DNS resolution entirely and dials a fixed
+	// host:port.
+	RuleActionStatic RuleAction = "static"
+)
+
+// Rule maps an SNI pattern to an action. Pattern may be an exact hostname
+// (e.g. "example.com"), a single-level wildcard (e.g. "*.example.com",
+// which matches "foo.example.com" but neither "example.com" itself nor
+// "foo.bar.example.com"), or, when prefixed with "regex:", an arbitrary
+// regular expression matched against the full SNI.
+type Rule struct {
+	Pattern    string     `json:"pattern" yaml:"pattern"`
+	Action     RuleAction `json:"action" yaml:"action"`
+	RewriteTo  string     `json:"rewrite_to,omitempty" yaml:"rewrite_to,omitempty"`
+	StaticAddr string     `json:"static_addr,omitempty" yaml:"static_addr,omitempty"`
+	ResetConn  bool       `json:"reset,omitempty" yaml:"reset,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	switch {
+	case strings.HasPrefix(r.Pattern, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(r.Pattern, "regex:"))
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", r.Pattern, err)
+		}
+		r.re = re
+	case strings.HasPrefix(r.Pattern, "*."):
+		re, err := regexp.Compile(`(?i)^[^.]+\.` + regexp.QuoteMeta(strings.TrimPrefix(r.Pattern, "*.")) + `$`)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", r.Pattern, err)
+		}
+		r.re = re
+	}
+
+	switch r.Action {
+	case RuleActionAllow, RuleActionDeny, RuleActionRewrite, RuleActionStatic:
+	default:
+		return fmt.Errorf("rule %q: unknown action %q", r.Pattern, r.Action)
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(serverName string) bool {
+	if r.re != nil {
+		return r.re.MatchString(serverName)
+	}
+	return strings.EqualFold(r.Pattern, serverName)
+}
+
+// Decision is the outcome of matching an SNI against the configured rules.
+type Decision struct {
+	Action     RuleAction
+	RewriteTo  string
+	StaticAddr string
+	ResetConn  bool
+}
+
+// Router matches client SNIs against a reloadable set of Rules, falling
+// back to RuleActionAllow when no rule matches or no rules file is
+// configured.
+type Router struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []*Rule
+
+	counters sync.Map // pattern -> *int64
+}
+
+// NewRouter loads rules from path and starts a SIGHUP-triggered reload
+// loop. Pass an empty path to get a Router that always allows.
+func NewRouter(path string) (*Router, error) {
+	router := &Router{path: path}
+	if path == "" {
+		return router, nil
+	}
+
+	if err := router.Reload(); err != nil {
+		return nil, err
+	}
+
+	go router.watchSIGHUP()
+
+	return router, nil
+}
+
+// Reload re-reads and recompiles the rules file, atomically swapping it in
+// on success. A malformed file leaves the previously loaded rules in place.
+func (router *Router) Reload() error {
+	rules, err := loadRules(router.path)
+	if err != nil {
+		return err
+	}
+
+	router.mu.Lock()
+	router.rules = rules
+	router.mu.Unlock()
+
+	return nil
+}
+
+func (router *Router) watchSIGHUP() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	for range sigCh {
+		if err := router.Reload(); err != nil {
+			log.Printf("Failed to reload rules file %s: %v", router.path, err)
+			continue
+		}
+		log.Printf("Reloaded rules file %s", router.path)
+	}
+}
+
+// Decide returns the routing Decision for serverName, incrementing the
+// matched rule's counter. With no rules loaded it always allows.
+func (router *Router) Decide(serverName string) Decision {
+	router.mu.RLock()
+	rules := router.rules
+	router.mu.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.matches(serverName) {
+			continue
+		}
+
+		router.incrementCounter(rule.Pattern)
+
+		return Decision{
+			Action:     rule.Action,
+			RewriteTo:  rule.RewriteTo,
+			StaticAddr: rule.StaticAddr,
+			ResetConn:  rule.ResetConn,
+		}
+	}
+
+	return Decision{Action: RuleActionAllow}
+}
+
+func (router *Router) incrementCounter(pattern string) {
+	counter, _ := router.counters.LoadOrStore(pattern, new(int64))
+	atomic.AddInt64(counter.(*int64), 1)
+}
+
+// Counters returns a snapshot of per-rule match counts, keyed by pattern.
+func (router *Router) Counters() map[string]int64 {
+	snapshot := make(map[string]int64)
+	router.counters.Range(func(key, value any) bool {
+		snapshot[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return snapshot
+}
+
+// loadRules reads and parses the rules file at path. The format is chosen
+// by file extension: ".yaml" or ".yml" is parsed as YAML, anything else
+// (including ".json" and no extension) as JSON.
+func loadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules file: %w", err)
+	}
+
+	var rules []*Rule
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("parsing rules file: %w", err)
+		}
+	default:
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("parsing rules file: %w", err)
+		}
+	}
+
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		pattern    string
+		serverName string
+		want       bool
+	}{
+		{"exact match", "example.com", "example.com", true},
+		{"exact match is case-insensitive", "Example.com", "example.COM", true},
+		{"exact pattern does not match a subdomain", "example.com", "foo.example.com", false},
+		{"single-level wildcard matches one label", "*.example.com", "foo.example.com", true},
+		{"single-level wildcard does not match the bare domain", "*.example.com", "example.com", false},
+		{"single-level wildcard does not match two labels", "*.example.com", "foo.bar.example.com", false},
+		{"single-level wildcard is case-insensitive", "*.Example.com", "FOO.example.COM", true},
+		{"regex prefix matches an arbitrary pattern", "regex:^(foo|bar)\\.example\\.com$", "bar.example.com", true},
+		{"regex prefix rejects a non-matching name", "regex:^(foo|bar)\\.example\\.com$", "baz.example.com", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &Rule{Pattern: tc.pattern, Action: RuleActionAllow}
+			if err := rule.compile(); err != nil {
+				t.Fatalf("compile(%q): %v", tc.pattern, err)
+			}
+			if got := rule.matches(tc.serverName); got != tc.want {
+				t.Errorf("rule %q matches(%q) = %v, want %v", tc.pattern, tc.serverName, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleCompileRejectsUnknownAction(t *testing.T) {
+	rule := &Rule{Pattern: "example.com", Action: "bogus"}
+	if err := rule.compile(); err == nil {
+		t.Fatal("expected an error for an unknown action, got nil")
+	}
+}
+
+func TestRouterDecideFallsBackToAllow(t *testing.T) {
+	router := &Router{}
+	decision := router.Decide("anything.example.com")
+	if decision.Action != RuleActionAllow {
+		t.Errorf("Decide with no rules loaded = %v, want %v", decision.Action, RuleActionAllow)
+	}
+}
+
+func TestRouterDecideIncrementsCounters(t *testing.T) {
+	denyRule := &Rule{Pattern: "*.blocked.example.com", Action: RuleActionDeny}
+	if err := denyRule.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	router := &Router{rules: []*Rule{denyRule}}
+
+	decision := router.Decide("ads.blocked.example.com")
+	if decision.Action != RuleActionDeny {
+		t.Fatalf("Decide = %v, want %v", decision.Action, RuleActionDeny)
+	}
+
+	counters := router.Counters()
+	if counters["*.blocked.example.com"] != 1 {
+		t.Errorf("counter for matched pattern = %d, want 1", counters["*.blocked.example.com"])
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// upstreamDialer is the subset of net.Dialer used to reach the upstream
+// backend. It is satisfied by *net.Dialer directly, and by socks5Dialer /
+// httpConnectDialer when -upstream-proxy chains the connection through
+// another hop.
+type upstreamDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// newUpstreamDialer builds an upstreamDialer from a -upstream-proxy value.
+// Supported schemes are "socks5://[user:pass@]host:port" (RFC 1928, with
+// optional RFC 1929 username/password auth) and
+// "http://[user:pass@]host:port" (HTTP CONNECT). An empty proxyURL dials
+// directly.
+func newUpstreamDialer(proxyURL string) (upstreamDialer, error) {
+	if proxyURL == "" {
+		return &net.Dialer{}, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream proxy URL %q: %w", proxyURL, err)
+	}
+
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		return &socks5Dialer{proxyAddr: u.Host, username: username, password: password}, nil
+	case "http":
+		return &httpConnectDialer{proxyAddr: u.Host, username: username, password: password}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+}
+
+// socks5Dialer reaches address by speaking the SOCKS5 protocol (RFC 1928)
+// to proxyAddr, optionally authenticating with username/password (RFC
+// 1929).
+type socks5Dialer struct {
+	proxyAddr          string
+	username, password string
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SOCKS5 proxy %s: %w", d.proxyAddr, err)
+	}
+
+	if err := applyHandshakeDeadline(conn, ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := d.handshake(conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("clearing SOCKS5 handshake deadline: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, address string) error {
+	methods := []byte{0x00} // no auth
+	if d.username != "" {
+		methods = []byte{0x02} // username/password
+	}
+
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("sending SOCKS5 greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("reading SOCKS5 greeting reply: %w", err)
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS5 version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case 0x00: // no auth required
+	case 0x02:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("SOCKS5 proxy rejected all authentication methods")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("splitting target address %q: %w", address, err)
+	}
+
+	var portNum int
+	if _, err := fmt.Sscanf(port, "%d", &portNum); err != nil {
+		return fmt.Errorf("parsing target port %q: %w", port, err)
+	}
+
+	req := []byte{0x05, 0x01, 0x00} // VER, CMD=CONNECT, RSV
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		// Not an IP literal: send it as ATYP 0x03 (domain name) and let the
+		// SOCKS5 proxy resolve it, e.g. for a "static" routing rule whose
+		// static_addr is a hostname.
+		if len(host) > 255 {
+			return fmt.Errorf("SOCKS5 target hostname %q exceeds 255 bytes", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, 0x01)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(portNum>>8), byte(portNum))
+
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("sending SOCKS5 CONNECT request: %w", err)
+	}
+
+	connectReply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connectReply); err != nil {
+		return fmt.Errorf("reading SOCKS5 CONNECT reply: %w", err)
+	}
+	if connectReply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 CONNECT failed with reply code %d", connectReply[1])
+	}
+
+	var addrLen int
+	switch connectReply[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return fmt.Errorf("reading SOCKS5 bound domain length: %w", err)
+		}
+		addrLen = int(lenByte[0])
+	default:
+		return fmt.Errorf("unknown SOCKS5 address type %d", connectReply[3])
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil { // bound address + port
+		return fmt.Errorf("reading SOCKS5 bound address: %w", err)
+	}
+
+	return nil
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	req := []byte{0x01, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("sending SOCKS5 auth request: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("reading SOCKS5 auth reply: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 authentication failed")
+	}
+
+	return nil
+}
+
+// httpConnectDialer reaches address by issuing an HTTP CONNECT request to
+// proxyAddr, optionally with Proxy-Authorization basic auth.
+type httpConnectDialer struct {
+	proxyAddr          string
+	username, password string
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to HTTP CONNECT proxy %s: %w", d.proxyAddr, err)
+	}
+
+	if err := applyHandshakeDeadline(conn, ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending HTTP CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading HTTP CONNECT response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP CONNECT proxy returned status %q", resp.Status)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("clearing HTTP CONNECT handshake deadline: %w", err)
+	}
+
+	// br may already have buffered bytes the proxy sent immediately after
+	// its response headers (e.g. pipelined with the tunneled protocol);
+	// route all future reads through it instead of returning the bare
+	// conn, which would silently drop those bytes.
+	return &bufferedConn{Conn: conn, br: br}, nil
+}
+
+// bufferedConn is a net.Conn whose Read is served from a bufio.Reader that
+// was used to parse a handshake response, so that any bytes the reader
+// already pulled from the socket (and buffered past the parsed response)
+// are not lost when the handshake hands the connection back to its caller.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// applyHandshakeDeadline ties conn's deadline to ctx's, so that a SOCKS5 or
+// HTTP CONNECT handshake with an unresponsive proxy is bounded by the same
+// budget DialContext's caller (upstreamConnectTimeout, ultimately) already
+// agreed to, instead of being able to block forever.
+func applyHandshakeDeadline(conn net.Conn, ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("setting proxy handshake deadline: %w", err)
+	}
+	return nil
+}
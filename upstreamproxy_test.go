@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startFakeProxy listens on an ephemeral port and hands each accepted
+// connection to handle, returning the listener's address for use as
+// proxyAddr. The caller is responsible for closing the listener.
+func startFakeProxy(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("starting fake proxy listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestSocks5DialerIPLiteralTarget(t *testing.T) {
+	proxyAddr := startFakeProxy(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(br, greeting); err != nil {
+			return
+		}
+		methods := make([]byte, greeting[1])
+		io.ReadFull(br, methods)
+		conn.Write([]byte{0x05, 0x00}) // no auth required
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(br, req); err != nil {
+			return
+		}
+		if req[3] != 0x01 {
+			t.Errorf("expected ATYP 0x01 (IPv4) for an IP literal target, got %#x", req[3])
+		}
+		io.ReadFull(br, make([]byte, 4+2)) // IPv4 addr + port
+
+		// VER REP RSV ATYP BND.ADDR BND.PORT
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	})
+
+	d := &socks5Dialer{proxyAddr: proxyAddr}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", "203.0.113.1:443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSocks5DialerHostnameTargetUsesDomainATYP(t *testing.T) {
+	const wantHost = "static.example.com"
+
+	proxyAddr := startFakeProxy(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+
+		greeting := make([]byte, 2)
+		io.ReadFull(br, greeting)
+		methods := make([]byte, greeting[1])
+		io.ReadFull(br, methods)
+		conn.Write([]byte{0x05, 0x00})
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return
+		}
+		if header[3] != 0x03 {
+			t.Errorf("expected ATYP 0x03 (domain name) for a hostname target, got %#x", header[3])
+		}
+
+		lenByte := make([]byte, 1)
+		io.ReadFull(br, lenByte)
+		host := make([]byte, lenByte[0])
+		io.ReadFull(br, host)
+		if string(host) != wantHost {
+			t.Errorf("domain name = %q, want %q", host, wantHost)
+		}
+		io.ReadFull(br, make([]byte, 2)) // port
+
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	})
+
+	d := &socks5Dialer{proxyAddr: proxyAddr}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", wantHost+":443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+}
+
+func TestHTTPConnectDialerPreservesPipelinedBytes(t *testing.T) {
+	proxyAddr := startFakeProxy(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if _, err := br.ReadString('\n'); err != nil { // request line
+			return
+		}
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+
+		// Write the response and the first bytes of the tunneled protocol
+		// in a single Write, as a proxy that doesn't flush between the two
+		// would, to exercise the bufio.Reader look-ahead.
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\nEXTRADATA"))
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	d := &httpConnectDialer{proxyAddr: proxyAddr}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", "backend.example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	got := make([]byte, len("EXTRADATA"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading pipelined bytes: %v", err)
+	}
+	if string(got) != "EXTRADATA" {
+		t.Errorf("pipelined bytes = %q, want %q", got, "EXTRADATA")
+	}
+}
+
+func TestHTTPConnectDialerNonOKStatus(t *testing.T) {
+	proxyAddr := startFakeProxy(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		br.ReadString('\n')
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+	})
+
+	d := &httpConnectDialer{proxyAddr: proxyAddr}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err := d.DialContext(ctx, "tcp", "backend.example.com:443"); err == nil {
+		t.Fatal("expected an error for a non-200 CONNECT response, got nil")
+	}
+}